@@ -0,0 +1,134 @@
+// Package audio captures system audio and delivers timestamped PCM frames.
+package audio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Frame is a chunk of interleaved, signed 16-bit little-endian PCM samples
+// together with the wall-clock time at which it was captured.
+type Frame struct {
+	Data []byte
+	PTS  time.Duration
+}
+
+// Source produces a continuous stream of PCM frames from some system audio
+// device.
+type Source interface {
+	// Frames returns the channel frames are delivered on. It is closed once
+	// the source can no longer produce data.
+	Frames() <-chan Frame
+	Rate() int
+	Channels() int
+	Close() error
+}
+
+const (
+	bytesPerSample = 2 // S16LE
+	chunkSamples   = 960
+)
+
+// cmdSource runs an external recorder (parec, arecord, ...) and slices its
+// stdout into fixed-size PCM frames, stamping each with time.Since(start).
+type cmdSource struct {
+	cmd      *exec.Cmd
+	frames   chan Frame
+	rate     int
+	channels int
+}
+
+func (s *cmdSource) Frames() <-chan Frame { return s.frames }
+func (s *cmdSource) Rate() int            { return s.rate }
+func (s *cmdSource) Channels() int        { return s.channels }
+
+func (s *cmdSource) Close() error {
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	return s.cmd.Wait()
+}
+
+func (s *cmdSource) run(stdout io.Reader, start time.Time) {
+	defer close(s.frames)
+	chunkSize := chunkSamples * s.channels * bytesPerSample
+	r := bufio.NewReaderSize(stdout, chunkSize*4)
+	for {
+		buf := make([]byte, chunkSize)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		s.frames <- Frame{Data: buf, PTS: time.Since(start)}
+	}
+}
+
+// OpenPulse captures from a PulseAudio/PipeWire source (typically a
+// monitor source, e.g. "alsa_output.pci-0000_00_1f.3.analog-stereo.monitor")
+// via parec. Frame PTS is measured from start, so the caller should pass
+// the same start it uses for the video track to keep both in sync.
+func OpenPulse(device string, rate, channels int, start time.Time) (Source, error) {
+	args := []string{
+		"--format=s16le",
+		fmt.Sprintf("--rate=%d", rate),
+		fmt.Sprintf("--channels=%d", channels),
+		"--raw",
+	}
+	if device != "" {
+		args = append(args, "--device="+device)
+	}
+	return openCmdSource(exec.Command("parec", args...), rate, channels, start)
+}
+
+// OpenALSA captures from a raw ALSA device (e.g. "hw:0,0") via arecord.
+// Frame PTS is measured from start, so the caller should pass the same
+// start it uses for the video track to keep both in sync.
+func OpenALSA(device string, rate, channels int, start time.Time) (Source, error) {
+	if device == "" {
+		device = "default"
+	}
+	cmd := exec.Command("arecord",
+		"-D", device,
+		"-f", "S16_LE",
+		"-r", fmt.Sprintf("%d", rate),
+		"-c", fmt.Sprintf("%d", channels),
+		"-t", "raw")
+	return openCmdSource(cmd, rate, channels, start)
+}
+
+func openCmdSource(cmd *exec.Cmd, rate, channels int, start time.Time) (Source, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &cmdSource{
+		cmd:      cmd,
+		frames:   make(chan Frame, 16),
+		rate:     rate,
+		channels: channels,
+	}
+	go s.run(stdout, start)
+	return s, nil
+}
+
+// Open dispatches to a backend based on the "-audio" flag value, which is
+// of the form "pulse[:device]" or "alsa[:device]". start is the epoch
+// frame PTS is measured from; pass the same start used for the video
+// track's pts so the two tracks share one timeline.
+func Open(spec string, rate, channels int, start time.Time) (Source, error) {
+	backend, device, _ := strings.Cut(spec, ":")
+	switch backend {
+	case "pulse":
+		return OpenPulse(device, rate, channels, start)
+	case "alsa":
+		return OpenALSA(device, rate, channels, start)
+	default:
+		return nil, fmt.Errorf("audio: unknown backend %q (want \"pulse\" or \"alsa\")", backend)
+	}
+}
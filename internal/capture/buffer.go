@@ -0,0 +1,169 @@
+package capture
+
+import (
+	"reflect"
+	"sync/atomic"
+	"unsafe"
+
+	"honnef.co/go/xcapture/internal/shm"
+)
+
+const bytesPerPixel = 4
+
+// ringPages is the fixed page count of a Buffer: three pages form the
+// lock-free triple-buffered ring (Write/Commit on the producer side,
+// Acquire/Release on the consumer side), the fourth is scratch space
+// xshm.GetImage lands partial updates in before they're blitted into the
+// accumulation page, and the fifth is that accumulation page itself.
+const ringPages = 5
+
+const scratchPage = 3
+
+// accumPage holds the one full, continuously-maintained frame the
+// producer paints dirty rectangles into; see Buffer.Accum.
+const accumPage = 4
+
+// Buffer is a block of shared memory sliced into ringPages fixed-size
+// pages, implementing a single-producer/single-consumer triple buffer:
+// the producer always has a page to paint into that the consumer isn't
+// looking at, and the consumer always has the newest complete frame
+// available, without either side ever blocking on the other or copying
+// a full frame to hand it over.
+type Buffer struct {
+	Width  int
+	Height int
+	Pages  int
+	Data   []byte
+	ShmID  int
+
+	// state packs the ring's three page indices and a dirty flag: bits
+	// [0:2) hold the index of the "ready" page (the newest complete
+	// frame Acquire hasn't picked up yet), [2:4) the "display" page (the
+	// one Acquire last handed to the consumer), [4:6) the "write" page
+	// (the one Commit will publish next), and bit 6 is set when ready
+	// holds a frame newer than display.
+	//
+	// Write/Commit only ever mutate the write and ready fields; Acquire
+	// only ever mutates the ready and display fields. Both sides touch
+	// "ready", which is why every transition goes through
+	// compareAndSwapState instead of a plain store.
+	state int32
+}
+
+func packState(ready, display, write int32, dirty bool) int32 {
+	s := ready | display<<2 | write<<4
+	if dirty {
+		s |= 1 << 6
+	}
+	return s
+}
+
+func unpackState(s int32) (ready, display, write int32, dirty bool) {
+	return s & 3, (s >> 2) & 3, (s >> 4) & 3, s&(1<<6) != 0
+}
+
+func (b *Buffer) PageOffset(idx int) int {
+	return b.PageSize() * idx
+}
+
+func (b *Buffer) PageSize() int {
+	return b.Width * b.Height * bytesPerPixel
+}
+
+func (b *Buffer) Page(idx int) []byte {
+	offset := b.PageOffset(idx)
+	size := b.PageSize()
+	return b.Data[offset : offset+size : offset+size]
+}
+
+// Scratch returns the page xshm.GetImage should land partial updates in.
+// It is never part of the triple-buffered ring, so the producer is free
+// to hand its contents to blitRect without racing the consumer.
+func (b *Buffer) Scratch() []byte {
+	return b.Page(scratchPage)
+}
+
+// Accum returns the producer's full-frame accumulation page: the one
+// place a dirty rectangle from Scratch is blitted into before each
+// Commit. It is never part of the triple-buffered ring, so unlike a ring
+// page it's always the same page call to call, and always holds the
+// complete previous frame plus every dirty rectangle painted since --
+// never a frame from several commits back the way a ring page's rotation
+// would leave it after a partial blit.
+func (b *Buffer) Accum() []byte {
+	return b.Page(accumPage)
+}
+
+// Write returns the page the producer should publish the next frame
+// into. It may hold a frame from several commits ago (the ring only
+// guarantees it is neither the page the consumer currently has nor the
+// ready page waiting for the next Acquire),
+// so the producer must fill it completely -- e.g. by copying Accum
+// forward -- rather than paint only a dirty rectangle into it.
+func (b *Buffer) Write() []byte {
+	_, _, write, _ := unpackState(atomic.LoadInt32(&b.state))
+	return b.Page(int(write))
+}
+
+// Commit publishes the page last returned by Write as the newest ready
+// frame, and gives the producer back whichever page the consumer isn't
+// currently displaying, to paint into next.
+func (b *Buffer) Commit() {
+	for {
+		old := atomic.LoadInt32(&b.state)
+		ready, display, write, _ := unpackState(old)
+		new := packState(write, display, ready, true)
+		if atomic.CompareAndSwapInt32(&b.state, old, new) {
+			return
+		}
+	}
+}
+
+// Acquire returns the newest frame available to the consumer. ok is true
+// if a frame was published since the last Acquire; if it's false, nothing
+// has changed and the previously displayed page is returned again.
+func (b *Buffer) Acquire() (page []byte, ok bool) {
+	for {
+		old := atomic.LoadInt32(&b.state)
+		ready, display, write, dirty := unpackState(old)
+		if !dirty {
+			return b.Page(int(display)), false
+		}
+		new := packState(display, ready, write, false)
+		if atomic.CompareAndSwapInt32(&b.state, old, new) {
+			return b.Page(int(ready)), true
+		}
+	}
+}
+
+// Release returns the page most recently handed out by Acquire. It
+// exists so callers have a symmetric pair of calls to bracket their use
+// of a frame; the ring itself reclaims the display page lazily, the next
+// time Acquire swaps it out, so there's nothing for Release to do.
+func (b *Buffer) Release() {}
+
+func NewBuffer(width, height int) (Buffer, error) {
+	size := width * height * ringPages * bytesPerPixel
+	seg, err := shm.Create(size)
+	if err != nil {
+		return Buffer{}, err
+	}
+	data, err := seg.Attach()
+	if err != nil {
+		return Buffer{}, err
+	}
+	sh := &reflect.SliceHeader{
+		Data: uintptr(data),
+		Len:  size,
+		Cap:  size,
+	}
+	b := (*(*[]byte)(unsafe.Pointer(sh)))
+	return Buffer{
+		Width:  width,
+		Height: height,
+		Pages:  ringPages,
+		Data:   b,
+		ShmID:  seg.ID,
+		state:  packState(0, 1, 2, false),
+	}, nil
+}
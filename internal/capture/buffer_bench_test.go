@@ -0,0 +1,128 @@
+package capture
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// paintFrame stands in for xshm.GetImage + blitRect actually moving pixels
+// through a page, so the benchmarks below measure real memory traffic
+// instead of an empty Write/Commit round trip.
+func paintFrame(page []byte, n byte) {
+	for i := range page {
+		page[i] = n
+	}
+}
+
+// runBench drives write/commit from one producer goroutine committing as
+// fast as it can (standing in for DAMAGE-driven capture traffic), while
+// the benchmark loop acquires one frame per fps tick, the way the fps
+// ticker in main() does. The per-tick sleep is excluded from the timed
+// region -- it exists only to pace acquire against the producer, not to
+// be measured -- so ns/op reflects write+commit+acquire, not time.Sleep.
+// The "dropped-frames" metric counts ticks where acquire found nothing
+// new since the last one.
+func runBench(b *testing.B, fps int, write func() []byte, commit func(), acquire func() (isNew bool)) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var n byte
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				paintFrame(write(), n)
+				n++
+				commit()
+			}
+		}
+	}()
+
+	tick := time.Second / time.Duration(fps)
+	dropped := 0
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !acquire() {
+			dropped++
+		}
+		b.StopTimer()
+		time.Sleep(tick)
+		b.StartTimer()
+	}
+	b.StopTimer()
+
+	close(stop)
+	wg.Wait()
+
+	b.ReportMetric(float64(dropped), "dropped-frames")
+}
+
+func benchmarkRing(b *testing.B, width, height, fps int) {
+	buf, err := NewBuffer(width, height)
+	if err != nil {
+		b.Fatal(err)
+	}
+	runBench(b, fps, buf.Write, buf.Commit, func() bool {
+		_, ok := buf.Acquire()
+		return ok
+	})
+}
+
+func BenchmarkRing1080p60(b *testing.B) { benchmarkRing(b, 1920, 1080, 60) }
+func BenchmarkRing4K30(b *testing.B)    { benchmarkRing(b, 3840, 2160, 30) }
+
+// mutexDoubleBuffer is a minimal stand-in for the mutex-guarded
+// double-buffer-plus-scratch design the triple-buffered ring replaced, so
+// BenchmarkMutexDouble* below gives a direct before/after comparison
+// alongside BenchmarkRing*.
+type mutexDoubleBuffer struct {
+	pages [2][]byte
+	cur   int
+
+	mu    sync.Mutex
+	frame []byte
+	gen   uint64
+}
+
+func newMutexDoubleBuffer(width, height int) *mutexDoubleBuffer {
+	size := width * height * bytesPerPixel
+	return &mutexDoubleBuffer{pages: [2][]byte{make([]byte, size), make([]byte, size)}}
+}
+
+func (m *mutexDoubleBuffer) write() []byte {
+	return m.pages[m.cur]
+}
+
+func (m *mutexDoubleBuffer) commit() {
+	page := m.pages[m.cur]
+	m.cur = (m.cur + 1) % 2
+	m.mu.Lock()
+	m.frame = page
+	m.gen++
+	m.mu.Unlock()
+}
+
+func (m *mutexDoubleBuffer) acquire() (page []byte, gen uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.frame, m.gen
+}
+
+func benchmarkMutexDouble(b *testing.B, width, height, fps int) {
+	buf := newMutexDoubleBuffer(width, height)
+	var lastGen uint64
+	runBench(b, fps, buf.write, buf.commit, func() bool {
+		_, gen := buf.acquire()
+		isNew := gen != lastGen
+		lastGen = gen
+		return isNew
+	})
+}
+
+func BenchmarkMutexDouble1080p60(b *testing.B) { benchmarkMutexDouble(b, 1920, 1080, 60) }
+func BenchmarkMutexDouble4K30(b *testing.B)    { benchmarkMutexDouble(b, 3840, 2160, 30) }
@@ -0,0 +1,302 @@
+// Package capture drives one X drawable (a composited window, or a
+// region of the root window) via the DAMAGE extension and exposes its
+// latest frame for a compositor to pick up.
+package capture
+
+import (
+	"log"
+	"sync"
+
+	"github.com/BurntSushi/xgb/composite"
+	"github.com/BurntSushi/xgb/damage"
+	xshm "github.com/BurntSushi/xgb/shm"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/BurntSushi/xgbutil"
+	"github.com/BurntSushi/xgbutil/xevent"
+)
+
+// Source captures from a single drawable, tracking damage so it only
+// talks to the X server when something actually changed.
+type Source struct {
+	xu       *xgbutil.XUtil
+	buf      Buffer
+	segID    xshm.Seg
+	damageID damage.Damage
+
+	mu     sync.Mutex
+	width  int
+	height int
+
+	// originX, originY is this source's top-left corner in the coordinate
+	// space damage events and GetImage report in. It's zero for windows
+	// (their damage and pixmap contents are already window-local), and the
+	// region's offset on the root window for NewRegion/a monitor, whose
+	// damage is reported in root coordinates but whose buffer only covers
+	// the region.
+	originX, originY int16
+}
+
+// NewWindow captures from window win via the COMPOSITE extension,
+// following its size across ConfigureNotify events.
+func NewWindow(xu *xgbutil.XUtil, win xproto.Window) (*Source, error) {
+	if err := composite.RedirectWindowChecked(xu.Conn(), win, composite.RedirectAutomatic).Check(); err != nil {
+		return nil, err
+	}
+	geom, err := xproto.GetGeometry(xu.Conn(), xproto.Drawable(win)).Reply()
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := newSource(xu, int(geom.Width), int(geom.Height))
+	if err != nil {
+		return nil, err
+	}
+
+	pix, err := xproto.NewPixmapId(xu.Conn())
+	if err != nil {
+		return nil, err
+	}
+	composite.NameWindowPixmap(xu.Conn(), win, pix)
+	s.createDamage(xproto.Drawable(pix))
+
+	configureEvents := make(chan xevent.ConfigureNotifyEvent, 1e4)
+	xevent.ConfigureNotifyFun(func(xu *xgbutil.XUtil, ev xevent.ConfigureNotifyEvent) {
+		configureEvents <- ev
+	}).Connect(xu, win)
+	if err := xproto.ChangeWindowAttributesChecked(xu.Conn(), win,
+		xproto.CwEventMask, []uint32{uint32(xproto.EventMaskStructureNotify)}).Check(); err != nil {
+		return nil, err
+	}
+
+	damageEvents := s.subscribeDamage(xu, xproto.Drawable(pix))
+
+	go s.run(xproto.Drawable(pix), damageEvents, func(ev xevent.ConfigureNotifyEvent) xproto.Drawable {
+		damage.Destroy(xu.Conn(), s.damageID)
+		xproto.FreePixmap(xu.Conn(), pix)
+		var err error
+		pix, err = xproto.NewPixmapId(xu.Conn())
+		if err != nil {
+			log.Fatal("capture: could not obtain ID for pixmap:", err)
+		}
+		composite.NameWindowPixmap(xu.Conn(), win, pix)
+		s.createDamage(xproto.Drawable(pix))
+		return xproto.Drawable(pix)
+	}, configureEvents)
+
+	return s, nil
+}
+
+// NewRegion captures rect, in root-window coordinates, directly off the
+// root drawable. Unlike NewWindow it never calls composite.RedirectWindow
+// -- there is no window to redirect, and GetImage works on the root
+// drawable as-is.
+func NewRegion(xu *xgbutil.XUtil, rect xproto.Rectangle) (*Source, error) {
+	s, err := newSource(xu, int(rect.Width), int(rect.Height))
+	if err != nil {
+		return nil, err
+	}
+	s.originX, s.originY = rect.X, rect.Y
+	root := xproto.Drawable(xu.RootWin())
+	s.createDamage(root)
+	damageEvents := s.subscribeDamage(xu, root)
+	// A region has no ConfigureNotify of its own; it rides however big
+	// the root window already is.
+	go s.run(root, damageEvents, nil, nil)
+	return s, nil
+}
+
+func newSource(xu *xgbutil.XUtil, width, height int) (*Source, error) {
+	segID, err := xshm.NewSegId(xu.Conn())
+	if err != nil {
+		return nil, err
+	}
+	buf, err := NewBuffer(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if err := xshm.AttachChecked(xu.Conn(), segID, uint32(buf.ShmID), false).Check(); err != nil {
+		return nil, err
+	}
+	damageID, err := damage.NewDamageId(xu.Conn())
+	if err != nil {
+		return nil, err
+	}
+	return &Source{xu: xu, buf: buf, segID: segID, damageID: damageID, width: width, height: height}, nil
+}
+
+func (s *Source) createDamage(drawable xproto.Drawable) {
+	if err := damage.CreateChecked(s.xu.Conn(), s.damageID, drawable, damage.ReportLevelBoundingBox).Check(); err != nil {
+		log.Fatal("capture: could not create damage object:", err)
+	}
+}
+
+func (s *Source) subscribeDamage(xu *xgbutil.XUtil, drawable xproto.Drawable) chan xproto.Rectangle {
+	damageEvents := make(chan xproto.Rectangle, 1e4)
+	xevent.DamageNotifyFun(func(xu *xgbutil.XUtil, ev damage.NotifyEvent) {
+		damageEvents <- ev.Area
+	}).Connect(xu, xproto.Window(drawable))
+	return damageEvents
+}
+
+// Frame returns the most recently published frame (tightly packed BGRA)
+// and its dimensions. It may be called concurrently with run.
+//
+// The dimensions are clamped to the ring's allocated size: s.width/height
+// track the drawable's current size and grow as soon as a ConfigureNotify
+// reports it, but the ring itself is sized once, at construction, for the
+// drawable's size at that time. Reporting the grown size before the ring
+// is reallocated to match would have a caller read past the page.
+func (s *Source) Frame() ([]byte, int, int) {
+	page, _ := s.buf.Acquire()
+	s.mu.Lock()
+	width, height := s.width, s.height
+	s.mu.Unlock()
+	if width > s.buf.Width {
+		width = s.buf.Width
+	}
+	if height > s.buf.Height {
+		height = s.buf.Height
+	}
+	return page, width, height
+}
+
+// Size returns the source's current dimensions, which may change after a
+// resize of the underlying window.
+func (s *Source) Size() (width, height int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.width, s.height
+}
+
+// run is the damage-driven capture loop: block for damage (or, for
+// windows, a resize), and only then talk to the X server, patching the
+// dirty rectangle into the accumulated frame and publishing a full copy
+// of it into the ring.
+func (s *Source) run(drawable xproto.Drawable, damageEvents chan xproto.Rectangle, onResize func(xevent.ConfigureNotifyEvent) xproto.Drawable, configureEvents chan xevent.ConfigureNotifyEvent) {
+	for {
+		select {
+		case ev := <-configureEvents:
+			if int(ev.Width) != s.width || int(ev.Height) != s.height {
+				s.mu.Lock()
+				s.width = int(ev.Width)
+				s.height = int(ev.Height)
+				s.mu.Unlock()
+			}
+			drawable = onResize(ev)
+		case rect := <-damageEvents:
+		drain:
+			for {
+				select {
+				case r := <-damageEvents:
+					rect = unionRect(rect, r)
+				default:
+					break drain
+				}
+			}
+
+			// Subtract unconditionally, for every notification we take off
+			// the channel (coalesced or not): with ReportLevelBoundingBox
+			// the server only sends the next DamageNotify once the region
+			// goes empty->non-empty again, so any path below that bails
+			// out without subtracting would leave the region permanently
+			// armed and capture frozen on whatever we last painted. This
+			// matters most for NewRegion/-monitor, whose damage object is
+			// on the root drawable: damage outside our rect still arms it
+			// and takes the empty-rect skip below.
+			damage.Subtract(s.xu.Conn(), s.damageID, 0, 0)
+
+			// rect is in drawable coordinates, which for a region/monitor
+			// (damage created on the root window) is root-absolute, not
+			// relative to our buffer. Translate to buffer-local
+			// coordinates before clipping against it, then translate back
+			// to fetch the matching pixels off the drawable.
+			local := xproto.Rectangle{X: rect.X - s.originX, Y: rect.Y - s.originY, Width: rect.Width, Height: rect.Height}
+			local = clipRect(local, s.buf.Width, s.buf.Height)
+			if local.Width == 0 || local.Height == 0 {
+				continue
+			}
+			fetch := xproto.Rectangle{X: local.X + s.originX, Y: local.Y + s.originY, Width: local.Width, Height: local.Height}
+
+			_, err := xshm.GetImage(s.xu.Conn(), drawable, fetch.X, fetch.Y, fetch.Width, fetch.Height, 0xFFFFFFFF, xproto.ImageFormatZPixmap, s.segID, uint32(s.buf.PageOffset(scratchPage))).Reply()
+			if err != nil {
+				log.Println("capture: could not fetch contents:", err)
+				continue
+			}
+
+			// Write may hold a frame from several commits back (the ring
+			// only guarantees it is neither the page the consumer
+			// currently has nor the ready page), so painting just the dirty rectangle into
+			// it would ghost in whatever changed elsewhere since. Keep
+			// the one true accumulated frame in Accum, patch it with the
+			// dirty rectangle, and copy the whole thing forward into
+			// Write before publishing it.
+			blitRect(s.buf.Accum(), s.buf.Scratch(), s.buf.Width, local)
+			copy(s.buf.Write(), s.buf.Accum())
+			s.buf.Commit()
+		}
+	}
+}
+
+// unionRect returns the smallest rectangle containing both a and b.
+func unionRect(a, b xproto.Rectangle) xproto.Rectangle {
+	x0 := min16(a.X, b.X)
+	y0 := min16(a.Y, b.Y)
+	x1 := max16(a.X+int16(a.Width), b.X+int16(b.Width))
+	y1 := max16(a.Y+int16(a.Height), b.Y+int16(b.Height))
+	return xproto.Rectangle{X: x0, Y: y0, Width: uint16(x1 - x0), Height: uint16(y1 - y0)}
+}
+
+// clipRect clips rect to the [0,0)-(width,height) buffer bounds, returning
+// a zero-size rectangle if it falls entirely outside them.
+func clipRect(rect xproto.Rectangle, width, height int) xproto.Rectangle {
+	if rect.X < 0 {
+		if int(rect.Width) <= -int(rect.X) {
+			return xproto.Rectangle{}
+		}
+		rect.Width -= uint16(-rect.X)
+		rect.X = 0
+	}
+	if rect.Y < 0 {
+		if int(rect.Height) <= -int(rect.Y) {
+			return xproto.Rectangle{}
+		}
+		rect.Height -= uint16(-rect.Y)
+		rect.Y = 0
+	}
+	if int(rect.X) >= width || int(rect.Y) >= height {
+		return xproto.Rectangle{}
+	}
+	if int(rect.X)+int(rect.Width) > width {
+		rect.Width = uint16(width - int(rect.X))
+	}
+	if int(rect.Y)+int(rect.Height) > height {
+		rect.Height = uint16(height - int(rect.Y))
+	}
+	return rect
+}
+
+// blitRect copies the tightly-packed rect-sized image in src (as written
+// by xshm.GetImage) into dst at rect's (X, Y), where dst has the given
+// stride in pixels.
+func blitRect(dst, src []byte, dstStride int, rect xproto.Rectangle) {
+	for row := 0; row < int(rect.Height); row++ {
+		srcOff := row * int(rect.Width) * bytesPerPixel
+		dstOff := (int(rect.Y)+row)*dstStride*bytesPerPixel + int(rect.X)*bytesPerPixel
+		n := int(rect.Width) * bytesPerPixel
+		copy(dst[dstOff:dstOff+n], src[srcOff:srcOff+n])
+	}
+}
+
+func min16(a, b int16) int16 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max16(a, b int16) int16 {
+	if a > b {
+		return a
+	}
+	return b
+}
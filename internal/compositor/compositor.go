@@ -0,0 +1,104 @@
+// Package compositor combines the frames from one or more capture sources
+// into a single BGRA destination frame.
+package compositor
+
+// Layer is one positioned input to a Compositor: Get returns the layer's
+// most recent frame (tightly packed BGRA, no padding) and its dimensions.
+type Layer struct {
+	X, Y int
+	Get  func() (frame []byte, width, height int)
+}
+
+// Compositor blits a fixed set of layers into a destination frame of a
+// given size on every Compose call.
+type Compositor struct {
+	Width, Height int
+	Layers        []Layer
+}
+
+// Compose blits every layer into dst, which must be Width*Height*4 bytes
+// of BGRA, in layer order (later layers painted on top). The first layer
+// with a frame is the base: it's copied in opaque, since captured
+// window/root content generally has a meaningless (often zero) pad byte
+// where real ARGB content would have alpha, and alpha-blending that over
+// the zeroed canvas would make it fade towards black. Every layer after
+// the base is a true overlay and gets alpha-blended as usual.
+func (c *Compositor) Compose(dst []byte) {
+	for i := range dst {
+		dst[i] = 0
+	}
+	base := true
+	for _, l := range c.Layers {
+		frame, w, h := l.Get()
+		if frame == nil {
+			continue
+		}
+		if base {
+			OpaqueBlit(dst, c.Width, c.Height, l.X, l.Y, frame, w, h)
+			base = false
+			continue
+		}
+		AlphaBlit(dst, c.Width, c.Height, l.X, l.Y, frame, w, h)
+	}
+}
+
+const bytesPerPixel = 4
+
+// OpaqueBlit copies src (w x h, tightly packed BGRA) into dst (dstWidth x
+// dstHeight, tightly packed BGRA) at (dstX, dstY), ignoring src's alpha
+// byte and forcing the destination to fully opaque. Source rows or
+// columns that fall outside dst are clipped.
+func OpaqueBlit(dst []byte, dstWidth, dstHeight, dstX, dstY int, src []byte, w, h int) {
+	for row := 0; row < h; row++ {
+		dy := dstY + row
+		if dy < 0 || dy >= dstHeight {
+			continue
+		}
+		for col := 0; col < w; col++ {
+			dx := dstX + col
+			if dx < 0 || dx >= dstWidth {
+				continue
+			}
+			srcOff := (row*w + col) * bytesPerPixel
+			dstOff := (dy*dstWidth + dx) * bytesPerPixel
+			copy(dst[dstOff:dstOff+3], src[srcOff:srcOff+3])
+			dst[dstOff+3] = 255
+		}
+	}
+}
+
+// AlphaBlit blits src (w x h, tightly packed BGRA) into dst (dstWidth x
+// dstHeight, tightly packed BGRA) at (dstX, dstY), alpha-blending each
+// pixel with Blend. Source rows or columns that fall outside dst are
+// clipped.
+func AlphaBlit(dst []byte, dstWidth, dstHeight, dstX, dstY int, src []byte, w, h int) {
+	for row := 0; row < h; row++ {
+		dy := dstY + row
+		if dy < 0 || dy >= dstHeight {
+			continue
+		}
+		for col := 0; col < w; col++ {
+			dx := dstX + col
+			if dx < 0 || dx >= dstWidth {
+				continue
+			}
+			srcOff := (row*w + col) * bytesPerPixel
+			dstOff := (dy*dstWidth + dx) * bytesPerPixel
+			p := uint32(src[srcOff]) | uint32(src[srcOff+1])<<8 | uint32(src[srcOff+2])<<16 | uint32(src[srcOff+3])<<24
+			Blend(dst, dstOff, p)
+		}
+	}
+}
+
+// Blend alpha-composites the BGRA pixel p (as B | G<<8 | R<<16 | A<<24)
+// over dst at dstOff, in place. This is the same straight-alpha "over"
+// math xcapture has always used to composite the cursor onto a frame.
+func Blend(dst []byte, dstOff int, p uint32) {
+	alpha := (p >> 24) + 1
+	invAlpha := uint32(256 - (p >> 24))
+
+	dst[dstOff+3] = 255
+	dst[dstOff+2] = byte((alpha*uint32(byte(p>>16)) + invAlpha*uint32(dst[dstOff+2])) >> 8)
+	dst[dstOff+1] = byte((alpha*uint32(byte(p>>8)) + invAlpha*uint32(dst[dstOff+1])) >> 8)
+	dst[dstOff+0] = byte((alpha*uint32(byte(p>>0)) + invAlpha*uint32(dst[dstOff+0])) >> 8)
+}
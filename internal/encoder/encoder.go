@@ -0,0 +1,53 @@
+// Package encoder turns raw BGRA frames into the packets and CodecID/
+// CodecPrivate pair a Matroska TrackEntry needs, abstracting over the raw
+// (uncompressed), H.264 and VP9 backends.
+package encoder
+
+import (
+	"fmt"
+	"time"
+)
+
+// Encoder consumes raw BGRA frames and produces encoded packets, along with
+// whatever metadata the Matroska track entry needs to describe them.
+type Encoder interface {
+	// Init prepares the encoder for frames of the given dimensions and
+	// frame rate, returning the Matroska CodecID and CodecPrivate to put
+	// in the track's TrackEntry.
+	Init(width, height int, fps uint) (codecID string, codecPrivate []byte, err error)
+	// Encode encodes a single BGRA frame captured at pts. It may return no
+	// packets if the encoder is still buffering (e.g. B-frame reordering),
+	// and the packets it does return may be tagged with the pts of an
+	// earlier frame, not necessarily this one.
+	Encode(frame []byte, pts time.Duration) (packets []Packet, err error)
+	Close() error
+}
+
+// Packet is one encoded packet Encode emits, tagged with the pts of the
+// frame it was encoded from (which may have been submitted several Encode
+// calls earlier, if the backend buffers).
+type Packet struct {
+	Data     []byte
+	PTS      time.Duration
+	Keyframe bool
+}
+
+// Options configures a new Encoder.
+type Options struct {
+	Bitrate uint   // target bitrate in kbps; 0 means the backend's default
+	Preset  string // backend-specific speed/quality preset, e.g. "veryfast"
+}
+
+// New returns the Encoder backing the "-codec" flag.
+func New(name string, opts Options) (Encoder, error) {
+	switch name {
+	case "", "raw":
+		return &Raw{}, nil
+	case "h264":
+		return newFFmpeg(h264Config(opts)), nil
+	case "vp9":
+		return newFFmpeg(vp9Config(opts)), nil
+	default:
+		return nil, fmt.Errorf("encoder: unknown codec %q (want raw, h264 or vp9)", name)
+	}
+}
@@ -0,0 +1,174 @@
+package encoder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+)
+
+// ffmpegConfig describes how to invoke and demux one ffmpeg-backed codec.
+type ffmpegConfig struct {
+	codecID string
+	args    func(width, height, fps int) []string
+	// split reads one packet of demuxed output from r. frameEnd reports
+	// whether packet is the last one belonging to its encoded access unit
+	// (for h264's Annex-B stream, a keyframe's SPS/PPS/SEI NALs precede
+	// its slice NAL and share the slice's frameEnd; IVF already yields
+	// one packet per frame, so frameEnd is always true). Encode uses it
+	// to match packets back to the pts of the frame that produced them.
+	split func(r *bufio.Reader) (packet []byte, keyframe, frameEnd bool, err error)
+	// codecPrivate, if set, is fed every packet split emits for Init's
+	// priming frame, up to and including its frameEnd packet, and its last
+	// ok result becomes the track's CodecPrivate. Only
+	// h264 needs this (to pull SPS/PPS into an avcC record); VP9 and raw
+	// have no out-of-band CodecPrivate, so it's nil for them.
+	codecPrivate func(packet []byte) (private []byte, ok bool)
+}
+
+// ffmpegEncoder implements Encoder by piping raw BGRA frames into an
+// ffmpeg subprocess on stdin and demuxing its encoded output from stdout.
+type ffmpegEncoder struct {
+	cfg    ffmpegConfig
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	pktCh  chan ffmpegPacket
+
+	// ptsQueue holds the pts of every frame submitted to Encode that
+	// ffmpeg hasn't finished emitting packets for yet, oldest first.
+	// Packets are tagged with ptsQueue[0] as they arrive and it's popped
+	// on a frameEnd packet, so lookahead/B-frame buffering that delays a
+	// frame's output by several Encode calls still gets that frame's own
+	// pts rather than whichever frame happened to be submitted when the
+	// packet was finally read.
+	ptsQueue []time.Duration
+}
+
+type ffmpegPacket struct {
+	data     []byte
+	keyframe bool
+	frameEnd bool
+	err      error
+}
+
+func newFFmpeg(cfg ffmpegConfig) *ffmpegEncoder {
+	return &ffmpegEncoder{cfg: cfg}
+}
+
+func (f *ffmpegEncoder) Init(width, height int, fps uint) (string, []byte, error) {
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "bgra",
+		"-s", fmt.Sprintf("%dx%d", width, height),
+		"-r", fmt.Sprintf("%d", fps),
+		"-i", "pipe:0",
+	}
+	args = append(args, f.cfg.args(width, height, int(fps))...)
+	cmd := exec.Command("ffmpeg", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", nil, err
+	}
+	f.cmd = cmd
+	f.stdin = stdin
+	f.stdout = bufio.NewReaderSize(stdout, 1<<20)
+	f.pktCh = make(chan ffmpegPacket, 32)
+	go f.readPackets()
+
+	if f.cfg.codecPrivate == nil {
+		return f.cfg.codecID, nil, nil
+	}
+
+	// x264 only emits its SPS/PPS alongside an actual encoded frame, so
+	// there's no CodecPrivate to read until something has been encoded --
+	// prime the pipeline with one throwaway frame and pull it out of
+	// whatever that emits, before Init returns and any real frame reaches
+	// Encode. Keep draining through frameEnd so the priming frame's own
+	// slice NAL is consumed here too, instead of leaking out as the first
+	// packet the caller sees from Encode.
+	black := make([]byte, width*height*4)
+	if _, err := f.stdin.Write(black); err != nil {
+		return "", nil, err
+	}
+	var private []byte
+	for {
+		pkt, ok := <-f.pktCh
+		if !ok {
+			return "", nil, io.ErrClosedPipe
+		}
+		if pkt.err != nil {
+			return "", nil, pkt.err
+		}
+		if p, ok := f.cfg.codecPrivate(pkt.data); ok {
+			private = p
+		}
+		if pkt.frameEnd {
+			break
+		}
+	}
+	if private == nil {
+		return "", nil, fmt.Errorf("encoder: ffmpeg never emitted CodecPrivate for the priming frame")
+	}
+	return f.cfg.codecID, private, nil
+}
+
+func (f *ffmpegEncoder) readPackets() {
+	defer close(f.pktCh)
+	for {
+		pkt, keyframe, frameEnd, err := f.cfg.split(f.stdout)
+		if err != nil {
+			if err != io.EOF {
+				f.pktCh <- ffmpegPacket{err: err}
+			}
+			return
+		}
+		f.pktCh <- ffmpegPacket{data: pkt, keyframe: keyframe, frameEnd: frameEnd}
+	}
+}
+
+func (f *ffmpegEncoder) Encode(frame []byte, pts time.Duration) ([]Packet, error) {
+	if _, err := f.stdin.Write(frame); err != nil {
+		return nil, err
+	}
+	f.ptsQueue = append(f.ptsQueue, pts)
+
+	// ffmpeg may still be buffering (lookahead, B-frames); only forward
+	// packets once it has actually emitted them for an earlier frame.
+	var packets []Packet
+	for {
+		select {
+		case pkt, ok := <-f.pktCh:
+			if !ok {
+				return packets, io.ErrClosedPipe
+			}
+			if pkt.err != nil {
+				return packets, pkt.err
+			}
+			if len(f.ptsQueue) == 0 {
+				continue // shouldn't happen: every packet traces back to a queued frame
+			}
+			packets = append(packets, Packet{Data: pkt.data, PTS: f.ptsQueue[0], Keyframe: pkt.keyframe})
+			if pkt.frameEnd {
+				f.ptsQueue = f.ptsQueue[1:]
+			}
+			continue
+		default:
+		}
+		break
+	}
+	return packets, nil
+}
+
+func (f *ffmpegEncoder) Close() error {
+	f.stdin.Close()
+	return f.cmd.Wait()
+}
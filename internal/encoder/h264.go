@@ -0,0 +1,151 @@
+package encoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// h264Config backs the "-codec h264" flag with an exec-based ffmpeg/libx264
+// pipeline. ffmpeg emits an Annex-B byte stream with in-band SPS/PPS;
+// splitAnnexB reframes each NAL as a length-prefixed AVCC packet (what
+// Matroska's V_MPEG4/ISO/AVC CodecID and RTP both expect once the
+// parameter sets are carried out of band), and avcDecoderConfig pulls the
+// first SPS/PPS pair out of that stream into the track's CodecPrivate.
+func h264Config(opts Options) ffmpegConfig {
+	preset := opts.Preset
+	if preset == "" {
+		preset = "veryfast"
+	}
+	return ffmpegConfig{
+		codecID: "V_MPEG4/ISO/AVC",
+		args: func(width, height, fps int) []string {
+			args := []string{
+				"-c:v", "libx264",
+				"-preset", preset,
+				"-tune", "zerolatency",
+				"-x264-params", "repeat-headers=1",
+				"-f", "h264",
+			}
+			if opts.Bitrate > 0 {
+				args = append(args, "-b:v", fmt.Sprintf("%dk", opts.Bitrate))
+			}
+			return append(args, "pipe:1")
+		},
+		split:        splitAnnexB,
+		codecPrivate: avcDecoderConfig(),
+	}
+}
+
+// splitAnnexB reads one Annex-B NAL unit from r, strips its start code and
+// re-emits it length-prefixed (4-byte big-endian length + NAL), and
+// reports whether it is an IDR slice. frameEnd is true for VCL NALs (an
+// IDR or non-IDR slice, types 5 and 1) -- x264 emits SPS/PPS/SEI alongside
+// a keyframe as separate NALs ahead of its slice, so the slice is the
+// signal that one encoded access unit is complete.
+func splitAnnexB(r *bufio.Reader) (packet []byte, keyframe, frameEnd bool, err error) {
+	if err := skipToStartCode(r); err != nil {
+		return nil, false, false, err
+	}
+	nal, err := r.ReadByte()
+	if err != nil {
+		return nil, false, false, err
+	}
+	nalType := nal & 0x1f
+	keyframe = nalType == 5 // IDR slice
+	frameEnd = nalType == 5 || nalType == 1
+	body := []byte{nal}
+loop:
+	for {
+		b, err := r.Peek(4)
+		if err != nil {
+			// Flush whatever is left on EOF or a short read.
+			rest, _ := io.ReadAll(r)
+			body = append(body, rest...)
+			break
+		}
+		if b[0] == 0 && b[1] == 0 && (b[2] == 1 || (b[2] == 0 && b[3] == 1)) {
+			break loop
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		body = append(body, c)
+	}
+	packet = make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(packet, uint32(len(body)))
+	return append(packet, body...), keyframe, frameEnd, nil
+}
+
+// avcDecoderConfig returns a codecPrivate extractor (see ffmpegConfig) that
+// watches a stream of length-prefixed NALs (as produced by splitAnnexB) for
+// the first SPS (type 7) and PPS (type 8), and once it has both, builds the
+// avcC AVCDecoderConfigurationRecord Matroska wants as CodecPrivate for
+// V_MPEG4/ISO/AVC.
+func avcDecoderConfig() func(packet []byte) ([]byte, bool) {
+	var sps, pps []byte
+	return func(packet []byte) ([]byte, bool) {
+		if len(packet) <= 4 {
+			return nil, false
+		}
+		switch packet[4] & 0x1f {
+		case 7:
+			sps = packet[4:]
+		case 8:
+			pps = packet[4:]
+		}
+		if len(sps) < 4 || pps == nil {
+			return nil, false
+		}
+		cfg := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+		cfg = appendU16Prefixed(cfg, sps)
+		cfg = append(cfg, 1)
+		cfg = appendU16Prefixed(cfg, pps)
+		return cfg, true
+	}
+}
+
+func appendU16Prefixed(dst, data []byte) []byte {
+	dst = append(dst, byte(len(data)>>8), byte(len(data)))
+	return append(dst, data...)
+}
+
+// SPSPPS extracts the (single) SPS and PPS NAL units back out of an avcC
+// AVCDecoderConfigurationRecord, as built by avcDecoderConfig, for
+// consumers (e.g. RTSP) that need the raw parameter sets rather than the
+// packaged CodecPrivate.
+func SPSPPS(avcC []byte) (sps, pps []byte, err error) {
+	if len(avcC) < 8 {
+		return nil, nil, fmt.Errorf("encoder: avcC record too short (%d bytes)", len(avcC))
+	}
+	spsLen := int(avcC[6])<<8 | int(avcC[7])
+	if len(avcC) < 8+spsLen+3 {
+		return nil, nil, fmt.Errorf("encoder: avcC record truncated before PPS")
+	}
+	sps = avcC[8 : 8+spsLen]
+	rest := avcC[8+spsLen:]
+	ppsLen := int(rest[1])<<8 | int(rest[2])
+	if len(rest) < 3+ppsLen {
+		return nil, nil, fmt.Errorf("encoder: avcC record truncated PPS")
+	}
+	pps = rest[3 : 3+ppsLen]
+	return sps, pps, nil
+}
+
+func skipToStartCode(r *bufio.Reader) error {
+	for {
+		b, err := r.Peek(3)
+		if err != nil {
+			return err
+		}
+		if b[0] == 0 && b[1] == 0 && b[2] == 1 {
+			r.Discard(3)
+			return nil
+		}
+		if _, err := r.ReadByte(); err != nil {
+			return err
+		}
+	}
+}
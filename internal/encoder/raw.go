@@ -0,0 +1,47 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// bitmapInfoHeader is a VFW BITMAPINFOHEADER, the CodecPrivate expected by
+// Matroska's "V_MS/VFW/FOURCC" CodecID for uncompressed video.
+type bitmapInfoHeader struct {
+	Size          uint32
+	Width         int32
+	Height        int32
+	Planes        uint16
+	BitCount      uint16
+	Compression   [4]byte
+	SizeImage     uint32
+	XPelsPerMeter int32
+	YPelsPerMeter int32
+	ClrUsed       uint32
+	ClrImportant  uint32
+}
+
+// Raw passes BGRA frames through unmodified, describing them with a VFW
+// BITMAPINFOHEADER. Every frame is a keyframe.
+type Raw struct{}
+
+func (r *Raw) Init(width, height int, fps uint) (string, []byte, error) {
+	bmp := bitmapInfoHeader{
+		Width:    int32(width),
+		Height:   int32(-height),
+		Planes:   1,
+		BitCount: 32,
+	}
+	codec := &bytes.Buffer{}
+	if err := binary.Write(codec, binary.LittleEndian, bmp); err != nil {
+		return "", nil, err
+	}
+	return "V_MS/VFW/FOURCC", codec.Bytes(), nil
+}
+
+func (r *Raw) Encode(frame []byte, pts time.Duration) ([]Packet, error) {
+	return []Packet{{Data: frame, PTS: pts, Keyframe: true}}, nil
+}
+
+func (r *Raw) Close() error { return nil }
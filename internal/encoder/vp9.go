@@ -0,0 +1,107 @@
+package encoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// vp9Config backs the "-codec vp9" flag with an exec-based ffmpeg/libvpx
+// pipeline, emitting frames in IVF container framing.
+func vp9Config(opts Options) ffmpegConfig {
+	deadline := "realtime"
+	switch opts.Preset {
+	case "good", "best", "realtime":
+		deadline = opts.Preset
+	}
+	return ffmpegConfig{
+		codecID: "V_VP9",
+		args: func(width, height, fps int) []string {
+			args := []string{
+				"-c:v", "libvpx-vp9",
+				"-deadline", deadline,
+				"-cpu-used", "5",
+				"-f", "ivf",
+			}
+			if opts.Bitrate > 0 {
+				args = append(args, "-b:v", fmt.Sprintf("%dk", opts.Bitrate))
+			}
+			return append(args, "pipe:1")
+		},
+		split: newIVFSplitter(),
+	}
+}
+
+// newIVFSplitter returns a split func that discards the 32-byte IVF file
+// header on its first call, then yields one complete frame per call
+// thereafter -- unlike h264's Annex-B stream, IVF already frames libvpx's
+// output one encoded picture at a time, so every call ends an access unit.
+func newIVFSplitter() func(r *bufio.Reader) (packet []byte, keyframe, frameEnd bool, err error) {
+	headerRead := false
+	return func(r *bufio.Reader) ([]byte, bool, bool, error) {
+		if !headerRead {
+			hdr := make([]byte, 32)
+			if _, err := io.ReadFull(r, hdr); err != nil {
+				return nil, false, false, err
+			}
+			headerRead = true
+		}
+		return readIVFFrame(r)
+	}
+}
+
+func readIVFFrame(r *bufio.Reader) (packet []byte, keyframe, frameEnd bool, err error) {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, false, false, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:4])
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, false, false, err
+	}
+	return frame, isVP9Keyframe(frame), true, nil
+}
+
+// isVP9Keyframe reads just enough of the VP9 uncompressed header (spec
+// section 6.2) to find frame_type: a 2-bit frame_marker (always 0b10, so
+// on its own it can't distinguish anything), a 2-bit profile, a
+// reserved_zero bit iff profile == 3, show_existing_frame (never a new
+// keyframe), and finally frame_type itself (0 == KEY_FRAME).
+func isVP9Keyframe(frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	br := vp9BitReader{data: frame}
+	br.bits(2) // frame_marker
+	profile := br.bits(1) | br.bits(1)<<1
+	if profile == 3 {
+		br.bits(1) // reserved_zero
+	}
+	if br.bits(1) == 1 { // show_existing_frame
+		return false
+	}
+	return br.bits(1) == 0 // frame_type
+}
+
+// vp9BitReader reads individual bits MSB-first out of a byte slice, the
+// way the VP9 uncompressed header is packed.
+type vp9BitReader struct {
+	data []byte
+	pos  int
+}
+
+func (br *vp9BitReader) bits(n int) byte {
+	var v byte
+	for i := 0; i < n; i++ {
+		byteIdx, bitIdx := br.pos/8, 7-br.pos%8
+		if byteIdx < len(br.data) {
+			v = v<<1 | (br.data[byteIdx]>>bitIdx)&1
+		} else {
+			v <<= 1
+		}
+		br.pos++
+	}
+	return v
+}
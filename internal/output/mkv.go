@@ -0,0 +1,164 @@
+package output
+
+import (
+	"io"
+	"sort"
+	"sync"
+
+	"honnef.co/go/matroska"
+	"honnef.co/go/matroska/ebml"
+)
+
+// VideoConfig describes the video track of an MKV output.
+type VideoConfig struct {
+	Width, Height int
+	FPS           uint
+	CodecID       string
+	CodecPrivate  []byte
+}
+
+// AudioConfig describes the audio track of an MKV output.
+type AudioConfig struct {
+	Rate, Channels int
+}
+
+// MKV streams Matroska to an io.Writer (typically stdout), one Cluster per
+// sample, the same layout xcapture has always produced.
+//
+// Video and audio samples arrive from two independent goroutines (the fps
+// ticker and the audio source's reader), so they reach WriteSample in
+// whatever order they happen to race in, not PTS order. Matroska needs
+// non-decreasing Cluster Timecodes, so when there's an audio track MKV
+// holds back each sample until it can prove nothing earlier is still in
+// flight on the other track, and emits in PTS order instead.
+type MKV struct {
+	mu      sync.Mutex
+	e       *ebml.Encoder
+	audio   bool
+	pending map[uint64][]Sample
+}
+
+// NewMKV writes the EBML/Segment/Tracks header to w and returns an Output
+// ready to receive samples for the configured tracks. audio may be nil.
+func NewMKV(w io.Writer, video VideoConfig, audio *AudioConfig) *MKV {
+	e := ebml.NewEncoder(w)
+	e.Emit(
+		ebml.EBML(
+			ebml.DocType(ebml.String("matroska")),
+			ebml.DocTypeVersion(ebml.Uint(4)),
+			ebml.DocTypeReadVersion(ebml.Uint(1))))
+
+	e.EmitHeader(matroska.Segment, -1)
+	e.Emit(
+		matroska.Info(
+			matroska.TimecodeScale(ebml.Uint(1)),
+			matroska.MuxingApp(ebml.UTF8("honnef.co/go/mkv")),
+			matroska.WritingApp(ebml.UTF8("xcapture"))))
+
+	videoTrack := matroska.TrackEntry(
+		matroska.TrackNumber(ebml.Uint(VideoTrack)),
+		matroska.TrackUID(ebml.Uint(0xDEADBEEF)),
+		matroska.TrackType(ebml.Uint(1)),
+		matroska.FlagLacing(ebml.Uint(0)),
+		matroska.DefaultDuration(ebml.Uint(1e9/uint64(video.FPS))),
+		matroska.CodecID(ebml.String(video.CodecID)),
+		matroska.CodecPrivate(ebml.Binary(video.CodecPrivate)),
+		matroska.Video(
+			matroska.PixelWidth(ebml.Uint(uint64(video.Width))),
+			matroska.PixelHeight(ebml.Uint(uint64(video.Height))),
+			matroska.ColourSpace(ebml.Binary("BGRA")),
+			matroska.Colour(
+				matroska.BitsPerChannel(ebml.Uint(8)))))
+	if audio != nil {
+		audioTrack := matroska.TrackEntry(
+			matroska.TrackNumber(ebml.Uint(AudioTrack)),
+			matroska.TrackUID(ebml.Uint(0xDEADBEF0)),
+			matroska.TrackType(ebml.Uint(2)),
+			matroska.FlagLacing(ebml.Uint(0)),
+			matroska.CodecID(ebml.String("A_PCM/INT/LIT")),
+			matroska.Audio(
+				matroska.SamplingFrequency(ebml.Float(float64(audio.Rate))),
+				matroska.Channels(ebml.Uint(uint64(audio.Channels))),
+				matroska.BitDepth(ebml.Uint(16))))
+		e.Emit(matroska.Tracks(videoTrack, audioTrack))
+	} else {
+		e.Emit(matroska.Tracks(videoTrack))
+	}
+	m := &MKV{e: e, audio: audio != nil}
+	if m.audio {
+		m.pending = make(map[uint64][]Sample)
+	}
+	return m
+}
+
+func (m *MKV) WriteSample(s Sample) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.audio {
+		return m.emit(s)
+	}
+	m.pending[s.Track] = append(m.pending[s.Track], s)
+	return m.drain()
+}
+
+// drain emits every sample that's provably next in PTS order: once both
+// tracks have a sample queued, whichever has the smaller PTS can't be
+// beaten by anything still in flight, since a track's own samples arrive
+// in PTS order and the other track already has something queued behind it.
+func (m *MKV) drain() error {
+	for len(m.pending[VideoTrack]) > 0 && len(m.pending[AudioTrack]) > 0 {
+		v := m.pending[VideoTrack][0]
+		a := m.pending[AudioTrack][0]
+		if v.PTS <= a.PTS {
+			if err := m.emit(v); err != nil {
+				return err
+			}
+			m.pending[VideoTrack] = m.pending[VideoTrack][1:]
+		} else {
+			if err := m.emit(a); err != nil {
+				return err
+			}
+			m.pending[AudioTrack] = m.pending[AudioTrack][1:]
+		}
+	}
+	return nil
+}
+
+func (m *MKV) emit(s Sample) error {
+	flags := byte(0)
+	if s.Keyframe {
+		flags = 0x80
+	}
+	block := []byte{0x80 | byte(s.Track), 0, 0, flags}
+	block = append(block, s.Data...)
+
+	m.e.Emit(
+		matroska.Cluster(
+			matroska.Timecode(ebml.Uint(uint64(s.PTS))),
+			matroska.Position(ebml.Uint(0)),
+			matroska.SimpleBlock(ebml.Binary(block))))
+	return m.e.Err
+}
+
+// Close flushes whatever samples never got paired off against the other
+// track, in PTS order, so a stream that stops one track before the other
+// (or never had one) doesn't lose its tail.
+func (m *MKV) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.audio {
+		return nil
+	}
+	var rest []Sample
+	rest = append(rest, m.pending[VideoTrack]...)
+	rest = append(rest, m.pending[AudioTrack]...)
+	sort.Slice(rest, func(i, j int) bool { return rest[i].PTS < rest[j].PTS })
+	for _, s := range rest {
+		if err := m.emit(s); err != nil {
+			return err
+		}
+	}
+	m.pending[VideoTrack] = nil
+	m.pending[AudioTrack] = nil
+	return nil
+}
@@ -0,0 +1,96 @@
+// Package output abstracts over the destinations encoded audio/video
+// samples can be written to: Matroska on stdout, RTSP, or WHEP/WebRTC.
+package output
+
+import (
+	"sync"
+	"time"
+)
+
+// Track numbers of the Matroska TrackEntry layout in mkv.go.
+const (
+	VideoTrack = 1
+	AudioTrack = 2
+)
+
+// Sample is one encoded packet ready to be written to an Output.
+type Sample struct {
+	Track    uint64
+	PTS      time.Duration
+	Data     []byte
+	Keyframe bool
+}
+
+// Output receives a stream of samples for one or more tracks.
+type Output interface {
+	WriteSample(s Sample) error
+	Close() error
+}
+
+// subscriberQueueLen bounds how many samples we'll buffer for a subscriber
+// before dropping rather than blocking the publisher.
+const subscriberQueueLen = 64
+
+type subscriber struct {
+	out Output
+	ch  chan Sample
+}
+
+// Hub fans samples out to a set of Outputs. Each subscriber is served by
+// its own goroutine from its own bounded queue, so a slow or stalled
+// output (e.g. no RTSP client has connected yet) gets frames dropped for
+// it instead of blocking capture or other subscribers.
+type Hub struct {
+	mu   sync.Mutex
+	subs []*subscriber
+}
+
+// Add registers out as a new subscriber and starts its delivery goroutine.
+func (h *Hub) Add(out Output) {
+	sub := &subscriber{out: out, ch: make(chan Sample, subscriberQueueLen)}
+	h.mu.Lock()
+	h.subs = append(h.subs, sub)
+	h.mu.Unlock()
+	go func() {
+		for s := range sub.ch {
+			sub.out.WriteSample(s)
+		}
+	}()
+}
+
+// Publish fans s out to every subscriber, dropping it for any subscriber
+// whose queue is still full rather than blocking the caller.
+//
+// Delivery is asynchronous and s.Data may be a buffer the caller reuses
+// for the next sample (e.g. the raw encoder hands back the compositor's
+// own destination frame), so Publish takes its own copy up front rather
+// than let queued subscribers race the next Publish call over the same
+// backing array.
+func (h *Hub) Publish(s Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	s.Data = append([]byte(nil), s.Data...)
+	for _, sub := range h.subs {
+		select {
+		case sub.ch <- s:
+		default:
+		}
+	}
+}
+
+// Close closes every subscriber's underlying Output.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var err error
+	for _, sub := range h.subs {
+		close(sub.ch)
+		if e := sub.out.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package output
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtph264"
+)
+
+// RTSP serves the H.264 video track over RTSP. Samples on the audio track
+// are ignored; every video sample is packetized as H.264, whatever codec
+// produced it. addr is of the form ":8554/live": the server listens on
+// the part before the first "/", and the path part is not checked, so a
+// client gets the stream whatever path it asks for.
+type RTSP struct {
+	server  *gortsplib.Server
+	stream  *gortsplib.ServerStream
+	track   *description.Media
+	encoder *rtph264.Encoder
+}
+
+// NewRTSP starts an RTSP server listening on addr and serving a single
+// H.264 video stream, using sps/pps extracted from the encoder's avcC
+// CodecPrivate (see encoder.SPSPPS).
+func NewRTSP(addr string, sps, pps []byte) (*RTSP, error) {
+	forma := &format.H264{
+		PayloadTyp:        96,
+		SPS:               sps,
+		PPS:               pps,
+		PacketizationMode: 1,
+	}
+	desc := &description.Session{
+		Medias: []*description.Media{{
+			Type:    description.MediaTypeVideo,
+			Formats: []format.Format{forma},
+		}},
+	}
+
+	enc, err := forma.CreateEncoder()
+	if err != nil {
+		return nil, fmt.Errorf("output: creating RTP encoder: %w", err)
+	}
+
+	r := &RTSP{track: desc.Medias[0], encoder: enc}
+	r.stream = gortsplib.NewServerStream(&gortsplib.Server{}, desc)
+	hostPort, _, _ := strings.Cut(addr, "/")
+	r.server = &gortsplib.Server{
+		Handler:     &rtspServerHandler{stream: r.stream},
+		RTSPAddress: hostPort,
+	}
+	if err := r.server.Start(); err != nil {
+		return nil, fmt.Errorf("output: starting RTSP server: %w", err)
+	}
+	return r, nil
+}
+
+func (r *RTSP) WriteSample(s Sample) error {
+	if s.Track != VideoTrack {
+		return nil
+	}
+	pkts, err := r.encoder.Encode([][]byte{stripLengthPrefix(s.Data)}, s.PTS)
+	if err != nil {
+		return fmt.Errorf("output: encoding RTP packets: %w", err)
+	}
+	for _, pkt := range pkts {
+		if err := r.stream.WritePacketRTP(r.track, pkt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RTSP) Close() error {
+	r.stream.Close()
+	r.server.Close()
+	return nil
+}
+
+// stripLengthPrefix removes the 4-byte big-endian length the h264 encoder
+// prefixes each NAL with (see splitAnnexB), leaving the raw NAL rtph264
+// expects to packetize itself.
+func stripLengthPrefix(nal []byte) []byte {
+	if len(nal) < 4 {
+		return nal
+	}
+	return nal[4:]
+}
+
+// rtspServerHandler implements the minimal gortsplib.ServerHandler needed
+// to serve a single always-on stream to any client that connects.
+type rtspServerHandler struct {
+	gortsplib.ServerHandlerOnConnOpen
+	stream *gortsplib.ServerStream
+}
+
+func (h *rtspServerHandler) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*gortsplib.Response, *gortsplib.ServerStream, error) {
+	return &gortsplib.Response{StatusCode: 200}, h.stream, nil
+}
+
+func (h *rtspServerHandler) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*gortsplib.Response, *gortsplib.ServerStream, error) {
+	return &gortsplib.Response{StatusCode: 200}, h.stream, nil
+}
+
+func (h *rtspServerHandler) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*gortsplib.Response, error) {
+	return &gortsplib.Response{StatusCode: 200}, nil
+}
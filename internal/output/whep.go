@@ -0,0 +1,152 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// WHEP serves a single H.264 video track to WebRTC viewers via the WHEP
+// protocol (one POST per viewer, SDP offer/answer, no signalling server
+// needed). addr is of the form ":8080/whep".
+type WHEP struct {
+	api   *webrtc.API
+	mu    sync.Mutex
+	conns []*whepConn
+	srv   *http.Server
+}
+
+type whepConn struct {
+	pc    *webrtc.PeerConnection
+	track *webrtc.TrackLocalStaticSample
+}
+
+// NewWHEP starts an HTTP server on the part of addr before the first "/"
+// whose single path (the rest of addr) accepts WHEP POSTs and negotiates a
+// new PeerConnection per viewer.
+func NewWHEP(addr string) (*WHEP, error) {
+	hostPort, path, _ := strings.Cut(addr, "/")
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	w := &WHEP{api: webrtc.NewAPI(webrtc.WithMediaEngine(m))}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/"+path, w.handleWHEP)
+	w.srv = &http.Server{Addr: hostPort, Handler: mux}
+	go w.srv.ListenAndServe()
+	return w, nil
+}
+
+func (w *WHEP) handleWHEP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "WHEP requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	pc, err := w.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "xcapture")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	offer, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+
+	rw.Header().Set("Content-Type", "application/sdp")
+	rw.Header().Set("Location", req.URL.Path)
+	rw.WriteHeader(http.StatusCreated)
+	fmt.Fprint(rw, pc.LocalDescription().SDP)
+
+	w.mu.Lock()
+	w.conns = append(w.conns, &whepConn{pc: pc, track: track})
+	w.mu.Unlock()
+
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed || s == webrtc.PeerConnectionStateDisconnected {
+			w.remove(pc)
+		}
+	})
+}
+
+func (w *WHEP) remove(pc *webrtc.PeerConnection) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, c := range w.conns {
+		if c.pc == pc {
+			w.conns = append(w.conns[:i], w.conns[i+1:]...)
+			break
+		}
+	}
+}
+
+func (w *WHEP) WriteSample(s Sample) error {
+	if s.Track != VideoTrack {
+		return nil
+	}
+	w.mu.Lock()
+	conns := append([]*whepConn(nil), w.conns...)
+	w.mu.Unlock()
+	annexB := toAnnexB(s.Data)
+	for _, c := range conns {
+		// Backpressure: a viewer whose PeerConnection can't keep up just
+		// misses frames, same as any other subscriber of the Hub.
+		c.track.WriteSample(media.Sample{Data: annexB, Duration: time.Second / 60})
+	}
+	return nil
+}
+
+// toAnnexB replaces the 4-byte big-endian length the h264 encoder prefixes
+// each NAL with (see splitAnnexB) with an Annex-B start code, which is what
+// pion's H264 payloader expects its input framed as -- unlike rtph264,
+// which rtsp.go hands the bare NAL with the length prefix stripped.
+func toAnnexB(nal []byte) []byte {
+	stripped := stripLengthPrefix(nal)
+	annexB := make([]byte, 0, len(startCode)+len(stripped))
+	annexB = append(annexB, startCode...)
+	return append(annexB, stripped...)
+}
+
+var startCode = []byte{0, 0, 0, 1}
+
+func (w *WHEP) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, c := range w.conns {
+		c.pc.Close()
+	}
+	return w.srv.Close()
+}
@@ -1,96 +1,122 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"reflect"
+	"strconv"
+	"strings"
 	"time"
-	"unsafe"
 
-	"honnef.co/go/matroska"
-	"honnef.co/go/matroska/ebml"
-	"honnef.co/go/xcapture/internal/shm"
+	"honnef.co/go/xcapture/internal/audio"
+	"honnef.co/go/xcapture/internal/capture"
+	"honnef.co/go/xcapture/internal/compositor"
+	"honnef.co/go/xcapture/internal/encoder"
+	"honnef.co/go/xcapture/internal/output"
 
 	"github.com/BurntSushi/xgb/composite"
+	"github.com/BurntSushi/xgb/damage"
 	xshm "github.com/BurntSushi/xgb/shm"
 	"github.com/BurntSushi/xgb/xfixes"
+	"github.com/BurntSushi/xgb/xinerama"
 	"github.com/BurntSushi/xgb/xproto"
 	"github.com/BurntSushi/xgbutil"
 	"github.com/BurntSushi/xgbutil/xevent"
 )
 
+const (
+	videoTrackNumber = 1
+	audioTrackNumber = 2
+)
+
 const bytesPerPixel = 4
 
-type Buffer struct {
-	Width  int
-	Height int
-	Pages  int
-	Data   []byte
-	ShmID  int
+// winSpec is one -win flag: a window to capture, and where to place it in
+// the composited frame.
+type winSpec struct {
+	id   xproto.Window
+	x, y int
 }
 
-func (b Buffer) PageOffset(idx int) int {
-	return b.PageSize() * idx
-}
+// winList collects repeated -win flags, each "<id>" or "<id>@<x>,<y>".
+type winList []winSpec
 
-func (b Buffer) PageSize() int {
-	return b.Width * b.Height * bytesPerPixel
+func (w *winList) String() string {
+	return fmt.Sprint([]winSpec(*w))
 }
 
-func (b Buffer) Page(idx int) []byte {
-	offset := b.PageOffset(idx)
-	size := b.PageSize()
-	return b.Data[offset : offset+size : offset+size]
+func (w *winList) Set(s string) error {
+	idStr, posStr, hasPos := strings.Cut(s, "@")
+	id, err := strconv.ParseUint(idStr, 0, 32)
+	if err != nil {
+		return fmt.Errorf("invalid window ID %q: %w", idStr, err)
+	}
+	spec := winSpec{id: xproto.Window(id)}
+	if hasPos {
+		if _, err := fmt.Sscanf(posStr, "%d,%d", &spec.x, &spec.y); err != nil {
+			return fmt.Errorf("invalid position %q: %w", posStr, err)
+		}
+	}
+	*w = append(*w, spec)
+	return nil
 }
 
-type BitmapInfoHeader struct {
-	Size          uint32
-	Width         int32
-	Height        int32
-	Planes        uint16
-	BitCount      uint16
-	Compression   [4]byte
-	SizeImage     uint32
-	XPelsPerMeter int32
-	YPelsPerMeter int32
-	ClrUsed       uint32
-	ClrImportant  uint32
+// parseRegion parses "x,y,width,height" into a root-window-relative
+// rectangle.
+func parseRegion(s string) (xproto.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return xproto.Rectangle{}, fmt.Errorf("want x,y,width,height, got %q", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return xproto.Rectangle{}, err
+		}
+		v[i] = n
+	}
+	return xproto.Rectangle{X: int16(v[0]), Y: int16(v[1]), Width: uint16(v[2]), Height: uint16(v[3])}, nil
 }
 
-func NewBuffer(width, height, pages int) (Buffer, error) {
-	size := width * height * pages * bytesPerPixel
-	seg, err := shm.Create(size)
-	if err != nil {
-		return Buffer{}, err
+// monitorRect looks up the geometry of Xinerama monitor idx, in
+// root-window coordinates.
+func monitorRect(xu *xgbutil.XUtil, idx int) (xproto.Rectangle, error) {
+	if err := xinerama.Init(xu.Conn()); err != nil {
+		return xproto.Rectangle{}, err
 	}
-	data, err := seg.Attach()
+	reply, err := xinerama.QueryScreens(xu.Conn()).Reply()
 	if err != nil {
-		return Buffer{}, err
+		return xproto.Rectangle{}, err
 	}
-	sh := &reflect.SliceHeader{
-		Data: uintptr(data),
-		Len:  size,
-		Cap:  size,
+	if idx < 0 || idx >= len(reply.ScreenInfo) {
+		return xproto.Rectangle{}, fmt.Errorf("monitor %d does not exist (have %d)", idx, len(reply.ScreenInfo))
 	}
-	b := (*(*[]byte)(unsafe.Pointer(sh)))
-	return Buffer{
-		Width:  width,
-		Height: height,
-		Pages:  pages,
-		Data:   b,
-		ShmID:  seg.ID,
-	}, nil
+	s := reply.ScreenInfo[idx]
+	return xproto.Rectangle{X: s.XOrg, Y: s.YOrg, Width: s.Width, Height: s.Height}, nil
 }
 
 func main() {
 	fps := flag.Uint("fps", 60, "FPS")
-	win := flag.Uint("win", 0, "Window ID")
+	var wins winList
+	flag.Var(&wins, "win", `Window to capture, optionally placed at an offset in the composited frame: "0x1234" or "0x1234@100,50". May be repeated to composite multiple windows.`)
+	region := flag.String("region", "", `Capture a region of the root window instead of a window, as "x,y,width,height"`)
+	monitor := flag.Int("monitor", -1, "Capture a single Xinerama monitor by index instead of a window")
+	audioSpec := flag.String("audio", "", `Audio source to record alongside video, e.g. "pulse:<monitor source>" or "alsa:hw:0,0" (default: no audio)`)
+	audioRate := flag.Uint("audio-rate", 48000, "Audio sample rate in Hz")
+	audioChannels := flag.Uint("audio-channels", 2, "Number of audio channels")
+	codecName := flag.String("codec", "raw", "Video codec: raw, h264 or vp9")
+	bitrate := flag.Uint("bitrate", 0, "Target video bitrate in kbps (0 = codec default)")
+	preset := flag.String("preset", "", "Codec-specific speed/quality preset (e.g. veryfast, realtime)")
+	rtspAddr := flag.String("rtsp", "", `Also serve the video track over RTSP at this address, e.g. ":8554/live" (requires -codec h264)`)
+	whepAddr := flag.String("whep", "", `Also serve the video track over WHEP/WebRTC at this address, e.g. ":8080/whep" (requires -codec h264)`)
 	flag.Parse()
 
+	if (*rtspAddr != "" || *whepAddr != "") && *codecName != "h264" {
+		log.Fatal("-rtsp and -whep require -codec h264")
+	}
+
 	xu, err := xgbutil.NewConn()
 	if err != nil {
 		log.Fatal("Couldn't connect to X server:", err)
@@ -106,224 +132,198 @@ func main() {
 		// TODO(dh) implement a slower version that is not using SHM
 		log.Fatal("MIT-SHM extension is not available:", err)
 	}
-	if err := composite.RedirectWindowChecked(xu.Conn(), xproto.Window(*win), composite.RedirectAutomatic).Check(); err != nil {
-		if err, ok := err.(xproto.AccessError); ok {
-			log.Fatal("Can't capture window, another program seems to be capturing it already:", err)
-		}
-		log.Fatal("Can't capture window:", err)
-	}
-	pix, err := xproto.NewPixmapId(xu.Conn())
-	if err != nil {
-		log.Fatal("Could not obtain ID for pixmap:", err)
-	}
-	composite.NameWindowPixmap(xu.Conn(), xproto.Window(*win), pix)
-
-	segID, err := xshm.NewSegId(xu.Conn())
-	if err != nil {
-		log.Fatal("Could not obtain ID for SHM:", err)
+	if err := damage.Init(xu.Conn()); err != nil {
+		log.Fatal("DAMAGE extension is not available:", err)
 	}
 
-	geom, err := xproto.GetGeometry(xu.Conn(), xproto.Drawable(*win)).Reply()
-	if err != nil {
-		log.Fatal("Could not determine window dimensions:", err)
-	}
-	width := geom.Width
-	height := geom.Height
+	go xevent.Main(xu)
 
-	buf, err := NewBuffer(int(width), int(height), 2)
-	if err != nil {
-		log.Fatal("Could not create shared memory:", err)
+	type placedSource struct {
+		src  *capture.Source
+		x, y int
 	}
-	if err := xshm.AttachChecked(xu.Conn(), segID, uint32(buf.ShmID), false).Check(); err != nil {
-		log.Fatal("Could not attach shared memory to X server:", err)
+	var placed []placedSource
+	var captureRect xproto.Rectangle // only set for -region/-monitor, for cursor placement
+	switch {
+	case *region != "":
+		rect, err := parseRegion(*region)
+		if err != nil {
+			log.Fatal("Invalid -region:", err)
+		}
+		src, err := capture.NewRegion(xu, rect)
+		if err != nil {
+			log.Fatal("Could not start region capture:", err)
+		}
+		captureRect = rect
+		placed = append(placed, placedSource{src, 0, 0})
+	case *monitor >= 0:
+		rect, err := monitorRect(xu, *monitor)
+		if err != nil {
+			log.Fatal("Could not determine monitor geometry:", err)
+		}
+		src, err := capture.NewRegion(xu, rect)
+		if err != nil {
+			log.Fatal("Could not start monitor capture:", err)
+		}
+		captureRect = rect
+		placed = append(placed, placedSource{src, 0, 0})
+	case len(wins) > 0:
+		for _, spec := range wins {
+			src, err := capture.NewWindow(xu, spec.id)
+			if err != nil {
+				log.Fatal("Could not capture window:", err)
+			}
+			placed = append(placed, placedSource{src, spec.x, spec.y})
+		}
+	default:
+		log.Fatal("Need at least one of -win, -region or -monitor")
 	}
 
-	i := 0
-	ch := make(chan []byte)
-
-	bmp := BitmapInfoHeader{
-		Width:    int32(width),
-		Height:   int32(-height),
-		Planes:   1,
-		BitCount: 32,
+	destW, destH := 0, 0
+	layers := make([]compositor.Layer, len(placed))
+	for i, p := range placed {
+		w, h := p.src.Size()
+		if p.x+w > destW {
+			destW = p.x + w
+		}
+		if p.y+h > destH {
+			destH = p.y + h
+		}
+		layers[i] = compositor.Layer{X: p.x, Y: p.y, Get: p.src.Frame}
 	}
-	codec := &bytes.Buffer{}
-	if err := binary.Write(codec, binary.LittleEndian, bmp); err != nil {
-		panic(err)
+	comp := &compositor.Compositor{Width: destW, Height: destH, Layers: layers}
+
+	// The cursor only has one well-defined position in the destination
+	// frame when we're compositing a single region/monitor or a single
+	// window; with several windows composited side by side there's no
+	// single answer, so we skip the overlay rather than guess.
+	var overlayCursor func(dst []byte)
+	switch {
+	case *region != "" || *monitor >= 0:
+		rx, ry := int(captureRect.X), int(captureRect.Y)
+		overlayCursor = func(dst []byte) {
+			cursor, err := xfixes.GetCursorImage(xu.Conn()).Reply()
+			if err != nil {
+				return
+			}
+			drawCursorAt(dst, destW, destH, int(cursor.X)-rx-int(cursor.Xhot), int(cursor.Y)-ry-int(cursor.Yhot), cursor)
+		}
+	case len(wins) == 1:
+		winID, ox, oy := wins[0].id, wins[0].x, wins[0].y
+		overlayCursor = func(dst []byte) {
+			cursor, err := xfixes.GetCursorImage(xu.Conn()).Reply()
+			if err != nil {
+				return
+			}
+			pos, err := xproto.TranslateCoordinates(xu.Conn(), xu.RootWin(), winID, cursor.X, cursor.Y).Reply()
+			if err != nil {
+				return
+			}
+			drawCursorAt(dst, destW, destH, int(pos.DstX)+ox-int(cursor.Xhot), int(pos.DstY)+oy-int(cursor.Yhot), cursor)
+		}
+	default:
+		overlayCursor = func([]byte) {}
 	}
 
-	e := ebml.NewEncoder(os.Stdout)
-	e.Emit(
-		ebml.EBML(
-			ebml.DocType(ebml.String("matroska")),
-			ebml.DocTypeVersion(ebml.Uint(4)),
-			ebml.DocTypeReadVersion(ebml.Uint(1))))
-
-	e.EmitHeader(matroska.Segment, -1)
-	e.Emit(
-		matroska.Info(
-			matroska.TimecodeScale(ebml.Uint(1)),
-			matroska.MuxingApp(ebml.UTF8("honnef.co/go/mkv")),
-			matroska.WritingApp(ebml.UTF8("xcapture"))))
+	startTime := time.Now()
 
-	e.Emit(
-		matroska.Tracks(
-			matroska.TrackEntry(
-				matroska.TrackNumber(ebml.Uint(1)),
-				matroska.TrackUID(ebml.Uint(0xDEADBEEF)),
-				matroska.TrackType(ebml.Uint(1)),
-				matroska.FlagLacing(ebml.Uint(0)),
-				matroska.DefaultDuration(ebml.Uint(time.Second/time.Duration(*fps))),
-				matroska.CodecID(ebml.String("V_MS/VFW/FOURCC")),
-				matroska.CodecPrivate(ebml.Binary(codec.Bytes())),
-				matroska.Video(
-					matroska.PixelWidth(ebml.Uint(width)),
-					matroska.PixelHeight(ebml.Uint(height)),
-					matroska.ColourSpace(ebml.Binary("BGRA")),
-					matroska.Colour(
-						matroska.BitsPerChannel(ebml.Uint(8)))))))
-
-	go xevent.Main(xu)
+	var audioSrc audio.Source
+	if *audioSpec != "" {
+		audioSrc, err = audio.Open(*audioSpec, int(*audioRate), int(*audioChannels), startTime)
+		if err != nil {
+			log.Fatal("Could not open audio source:", err)
+		}
+	}
 
-	configureEvents := make(chan xevent.ConfigureNotifyEvent, 1e4)
-	configCb := func(xu *xgbutil.XUtil, ev xevent.ConfigureNotifyEvent) {
-		configureEvents <- ev
+	enc, err := encoder.New(*codecName, encoder.Options{Bitrate: *bitrate, Preset: *preset})
+	if err != nil {
+		log.Fatal(err)
 	}
-	xevent.ConfigureNotifyFun(configCb).Connect(xu, xproto.Window(*win))
-	err = xproto.ChangeWindowAttributesChecked(xu.Conn(), xproto.Window(*win),
-		xproto.CwEventMask, []uint32{uint32(xproto.EventMaskStructureNotify)}).Check()
+	codecID, codecPrivate, err := enc.Init(destW, destH, *fps)
 	if err != nil {
-		log.Fatal("Couldn't monitor window for size changes:", err)
+		log.Fatal("Could not initialize encoder:", err)
 	}
 
-	idx := -1
-	var prevFrame []byte
-	sendFrame := func(b []byte) {
-		idx++
-		if b == nil {
-			b = prevFrame
-		}
-		prevFrame = b
-		block := []byte{
-			129,
-			0, 0,
-			128,
+	var audioCfg *output.AudioConfig
+	if audioSrc != nil {
+		audioCfg = &output.AudioConfig{Rate: audioSrc.Rate(), Channels: audioSrc.Channels()}
+	}
+	hub := &output.Hub{}
+	hub.Add(output.NewMKV(os.Stdout, output.VideoConfig{
+		Width:        destW,
+		Height:       destH,
+		FPS:          *fps,
+		CodecID:      codecID,
+		CodecPrivate: codecPrivate,
+	}, audioCfg))
+	if *rtspAddr != "" {
+		sps, pps, err := encoder.SPSPPS(codecPrivate)
+		if err != nil {
+			log.Fatal("Could not extract SPS/PPS for RTSP:", err)
 		}
-		block = append(block, b...)
-		e.Emit(
-			matroska.Cluster(
-				matroska.Timecode(ebml.Uint(idx*int(time.Second/time.Duration(*fps)))),
-				matroska.Position(ebml.Uint(0)),
-				matroska.SimpleBlock(ebml.Binary(block))))
-
-		if e.Err != nil {
-			log.Fatal(err)
+		rtsp, err := output.NewRTSP(*rtspAddr, sps, pps)
+		if err != nil {
+			log.Fatal("Could not start RTSP output:", err)
 		}
+		hub.Add(rtsp)
 	}
-
-	go func() {
-		d := time.Second / time.Duration(*fps)
-		t := time.NewTicker(d)
-		pts := time.Now()
-		dropped := 0
-		for ts := range t.C {
-			fps := float64(time.Second) / float64(ts.Sub(pts))
-			// XXX we are racing on width and height
-			fmt.Fprintf(os.Stderr, "\rFrame time: %14s (%4.2f FPS); %5d dropped; %4dx%4d -> %4dx%4d          ", ts.Sub(pts), fps, dropped, width, height, buf.Width, buf.Height)
-			pts = ts
-			select {
-			case b := <-ch:
-				sendFrame(b)
-			default:
-				dropped++
-				sendFrame(nil)
-			}
+	if *whepAddr != "" {
+		whep, err := output.NewWHEP(*whepAddr)
+		if err != nil {
+			log.Fatal("Could not start WHEP output:", err)
 		}
-	}()
-
-	scratch := make([]byte, buf.PageSize())
-	for {
-		select {
-		case ev := <-configureEvents:
-			if ev.Width != width || ev.Height != height {
-				width = ev.Width
-				height = ev.Height
+		hub.Add(whep)
+	}
 
-			}
-			// DRY
-			xproto.FreePixmap(xu.Conn(), pix)
-			var err error
-			pix, err = xproto.NewPixmapId(xu.Conn())
-			if err != nil {
-				log.Fatal("Could not obtain ID for pixmap:", err)
-			}
-			composite.NameWindowPixmap(xu.Conn(), xproto.Window(*win), pix)
-		default:
-			offset := buf.PageOffset(i)
-			w := width
-			if int(w) > buf.Width {
-				w = uint16(buf.Width)
-			}
-			h := height
-			if int(h) > buf.Height {
-				h = uint16(buf.Height)
-			}
-			_, err := xshm.GetImage(xu.Conn(), xproto.Drawable(pix), 0, 0, w, h, 0xFFFFFFFF, xproto.ImageFormatZPixmap, segID, uint32(offset)).Reply()
-			if err != nil {
-				log.Println("Could not fetch window contents:", err)
-				continue
-			}
+	sendBlock := func(trackNumber uint64, pts time.Duration, b []byte, keyframe bool) {
+		hub.Publish(output.Sample{Track: trackNumber, PTS: pts, Data: b, Keyframe: keyframe})
+	}
 
-			page := buf.Page(i)
+	sendFrame := func(b []byte, pts time.Duration) {
+		packets, err := enc.Encode(b, pts)
+		if err != nil {
+			log.Fatal("Could not encode frame:", err)
+		}
+		for _, packet := range packets {
+			sendBlock(videoTrackNumber, packet.PTS, packet.Data, packet.Keyframe)
+		}
+	}
 
-			// TODO(dh): instead of copying into scratch and back, we
-			// should have a third page that we can copy into and send
-			// directly onto the channel
-			if int(w) < buf.Width || int(h) < buf.Height {
-				copy(scratch, page)
-				for i := range page {
-					page[i] = 0
-				}
-				for i := 0; i < int(h); i++ {
-					copy(page[i*buf.Width*bytesPerPixel:], scratch[i*int(w)*bytesPerPixel:(i+1)*int(w)*bytesPerPixel])
-				}
+	if audioSrc != nil {
+		go func() {
+			for f := range audioSrc.Frames() {
+				sendBlock(audioTrackNumber, f.PTS, f.Data, true)
 			}
+		}()
+	}
 
-			drawCursor(xu, *win, buf, page)
-
-			ch <- page
-			i = (i + 1) % 2
-		}
+	d := time.Second / time.Duration(*fps)
+	t := time.NewTicker(d)
+	pts := time.Now()
+	dest := make([]byte, destW*destH*bytesPerPixel)
+	for ts := range t.C {
+		fpsNow := float64(time.Second) / float64(ts.Sub(pts))
+		fmt.Fprintf(os.Stderr, "\rFrame time: %14s (%4.2f FPS); %4dx%4d          ", ts.Sub(pts), fpsNow, destW, destH)
+		pts = ts
+
+		comp.Compose(dest)
+		overlayCursor(dest)
+		sendFrame(dest, ts.Sub(startTime))
 	}
 }
 
-func drawCursor(xu *xgbutil.XUtil, win uint, buf Buffer, page []byte) {
-	cursor, err := xfixes.GetCursorImage(xu.Conn()).Reply()
-	if err != nil {
-		return
-	}
-	pos, err := xproto.TranslateCoordinates(xu.Conn(), xu.RootWin(), xproto.Window(win), cursor.X, cursor.Y).Reply()
-	if err != nil {
-		return
-	}
-	if pos.DstY < 0 || pos.DstX < 0 || int(pos.DstY) > buf.Height || int(pos.DstX) > buf.Width {
-		// cursor outside of our window
-		return
-	}
+// drawCursorAt alpha-blends the XFIXES cursor image into dst (destWidth x
+// destHeight, tightly packed BGRA) with the image's top-left corner at
+// (x, y); callers subtract the hotspot to place the hotspot itself.
+func drawCursorAt(dst []byte, destWidth, destHeight, x, y int, cursor *xfixes.GetCursorImageReply) {
 	for i, p := range cursor.CursorImage {
-		row := i/int(cursor.Width) + int(pos.DstY) - int(cursor.Yhot)
-		col := i%int(cursor.Width) + int(pos.DstX) - int(cursor.Xhot)
-		if row >= buf.Height || col >= buf.Width || row < 0 || col < 0 {
+		row := y + i/int(cursor.Width)
+		col := x + i%int(cursor.Width)
+		if row >= destHeight || col >= destWidth || row < 0 || col < 0 {
 			// cursor is partially off-screen
 			break
 		}
-		off := row*buf.Width*bytesPerPixel + col*bytesPerPixel
-		alpha := (p >> 24) + 1
-		invAlpha := uint32(256 - (p >> 24))
-
-		page[off+3] = 255
-		page[off+2] = byte((alpha*uint32(byte(p>>16)) + invAlpha*uint32(page[off+2])) >> 8)
-		page[off+1] = byte((alpha*uint32(byte(p>>8)) + invAlpha*uint32(page[off+1])) >> 8)
-		page[off+0] = byte((alpha*uint32(byte(p>>0)) + invAlpha*uint32(page[off+0])) >> 8)
+		off := (row*destWidth + col) * bytesPerPixel
+		compositor.Blend(dst, off, p)
 	}
 }